@@ -0,0 +1,19 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg_test
+
+import (
+	"testing"
+
+	"github.com/rwxrob/keg/internal/teshtest"
+)
+
+// TestCLI drives the keg binary through tests/*.tesh transcripts,
+// covering the interactive command surface (current, titles, latest,
+// dex update, create, delete, random id) that depends on $EDITOR and
+// cwd resolution and so is awkward to exercise from Go unit tests
+// directly.
+func TestCLI(t *testing.T) {
+	teshtest.Run(t, `tests`)
+}
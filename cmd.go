@@ -26,11 +26,16 @@ func init() {
 	Z.Vars.SoftInit()
 }
 
+// cmdVersion is shared by Cmd and the LSP server's serverInfo so that
+// reporting it doesn't require an initialization-time reference to
+// Cmd itself (which would create an init cycle through lspCmd).
+const cmdVersion = `v0.4.1`
+
 var Cmd = &Z.Cmd{
 	Name:      `keg`,
 	Aliases:   []string{`kn`},
 	Summary:   `create and manage knowledge exchange graphs`,
-	Version:   `v0.4.1`,
+	Version:   cmdVersion,
 	Copyright: `Copyright 2022 Robert S Muhlestein`,
 	License:   `Apache-2.0`,
 	Site:      `rwxrob.tv`,
@@ -41,6 +46,8 @@ var Cmd = &Z.Cmd{
 		editCmd, help.Cmd, conf.Cmd, vars.Cmd,
 		dexCmd, createCmd, currentCmd, dirCmd, deleteCmd,
 		latestCmd, titleCmd, initCmd, randomCmd,
+		indexCmd, findCmd, lspCmd, tagsCmd, tagCmd, dailyCmd,
+		encryptCmd, decryptCmd,
 	},
 
 	Shortcuts: Z.ArgMap{
@@ -129,9 +136,11 @@ var titleCmd = &Z.Cmd{
 	Name:     `titles`,
 	Aliases:  []string{`title`},
 	Summary:  `find titles containing keyword`,
+	Usage:    `[--tag TAG] [--linked-by ID] [--orphan] [--since WHEN] [WORD...]`,
 	Commands: []*Z.Cmd{help.Cmd},
 
 	Call: func(x *Z.Cmd, args ...string) error {
+		args, opts := extractFilterFlags(args)
 		if len(args) == 0 {
 			args = append(args, "")
 		}
@@ -145,6 +154,10 @@ var titleCmd = &Z.Cmd{
 		if err != nil {
 			return err
 		}
+		dex, err = filterDex(keg.Path, dex, opts)
+		if err != nil {
+			return err
+		}
 		if term.IsInteractive() {
 			Z.Page(dex.WithTitleText(str).Pretty())
 		} else {
@@ -154,20 +167,82 @@ var titleCmd = &Z.Cmd{
 	},
 }
 
+// extractFilterFlags pulls the --tag, --linked-by, --orphan, and
+// --since flags out of args, returning the remaining positional
+// arguments alongside the parsed FilterOpts. Flags may appear
+// anywhere in args.
+func extractFilterFlags(args []string) ([]string, FilterOpts) {
+	var opts FilterOpts
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case `--tag`:
+			if i+1 < len(args) {
+				i++
+				opts.Tag = args[i]
+			}
+		case `--linked-by`:
+			if i+1 < len(args) {
+				i++
+				opts.LinkedBy = args[i]
+			}
+		case `--orphan`:
+			opts.Orphan = true
+		case `--since`:
+			if i+1 < len(args) {
+				i++
+				opts.Since = args[i]
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return rest, opts
+}
+
+// filterDex narrows dex down to the entries matching opts by
+// consulting the SQLite index. If opts is the zero value dex is
+// returned unchanged so callers that never pass filter flags pay no
+// index-opening cost.
+func filterDex(kegdir string, dex *Dex, opts FilterOpts) (*Dex, error) {
+	if opts == (FilterOpts{}) {
+		return dex, nil
+	}
+	ix, err := OpenIndex(kegdir)
+	if err != nil {
+		return nil, err
+	}
+	defer ix.Close()
+	ids, err := ix.Filter(opts)
+	if err != nil {
+		return nil, err
+	}
+	keep := map[int]bool{}
+	for _, id := range ids {
+		keep[id] = true
+	}
+	return dex.WithIDs(keep), nil
+}
+
 var dirCmd = &Z.Cmd{
 	Name:     `dir`,
 	Aliases:  []string{`d`},
-	MaxArgs:  1,
+	Usage:    `[--tag TAG] [--linked-by ID] [--orphan] [--since WHEN] [WORD]`,
 	Summary:  `print path to directory of current keg or node`,
 	Commands: []*Z.Cmd{help.Cmd},
 
 	Call: func(x *Z.Cmd, args ...string) error {
+		args, opts := extractFilterFlags(args)
 		keg, err := current(x.Caller)
 		if err != nil {
 			return err
 		}
 		if len(args) > 0 {
 			dex, _ := ReadDex(keg.Path)
+			dex, err = filterDex(keg.Path, dex, opts)
+			if err != nil {
+				return err
+			}
 			choice := dex.ChooseWithTitleText(strings.Join(args, " "))
 			term.Print(filepath.Join(keg.Path, strconv.Itoa(choice.N)))
 		} else {
@@ -205,11 +280,15 @@ var deleteCmd = &Z.Cmd{
 		if err != nil {
 			return err
 		}
-		err = MakeDex(keg.Path)
-		if err != nil {
+		n, _ := strconv.Atoi(id)
+		if err := DexRemove(keg.Path, n); err != nil {
 			return err
 		}
-		return Publish(keg.Path)
+		if ix, err := OpenIndex(keg.Path); err == nil {
+			ix.RemoveNode(n)
+			ix.Close()
+		}
+		return nil
 	},
 }
 
@@ -250,6 +329,82 @@ var dexCmd = &Z.Cmd{
 	Summary:  `work with indexes`,
 }
 
+var indexCmd = &Z.Cmd{
+	Name:     `index`,
+	Commands: []*Z.Cmd{help.Cmd, indexRebuildCmd},
+	Summary:  `work with the SQLite full-text search index`,
+
+	Description: `
+		The {{aka}} command manages dex/index.db, the SQLite database
+		that powers {{cmd "find"}} and the {{pre "--tag"}},
+		{{pre "--linked-by"}}, {{pre "--orphan"}}, and {{pre "--since"}}
+		filters accepted by {{cmd "titles"}}, {{cmd "random"}}, and
+		{{cmd "dir"}}.
+
+		The index is kept up to date incrementally by {{cmd "create"}},
+		{{cmd "edit"}}, and {{cmd "delete"}}. Use {{cmd "index rebuild"}}
+		to recover if it is ever missing or out of sync.
+
+	`,
+}
+
+var indexRebuildCmd = &Z.Cmd{
+	Name:     `rebuild`,
+	Commands: []*Z.Cmd{help.Cmd},
+	Summary:  `reindex every node from scratch`,
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		keg, err := current(x.Caller.Caller) // keg index rebuild
+		if err != nil {
+			return err
+		}
+		ix, err := OpenIndex(keg.Path)
+		if err != nil {
+			return err
+		}
+		defer ix.Close()
+		return ix.Rebuild(keg.Path)
+	},
+}
+
+var findCmd = &Z.Cmd{
+	Name:     `find`,
+	Usage:    `QUERY`,
+	Summary:  `full-text search node titles and bodies`,
+	Commands: []*Z.Cmd{help.Cmd},
+
+	Description: `
+		The {{aka}} command runs an FTS5 query (for example
+		{{pre "find \"foo AND bar\""}}) against dex/index.db and prints
+		the matching node ids and titles. Run {{cmd "index rebuild"}}
+		first if the index has never been built.
+
+	`,
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		if len(args) == 0 {
+			return x.UsageError()
+		}
+		keg, err := current(x.Caller)
+		if err != nil {
+			return err
+		}
+		ix, err := OpenIndex(keg.Path)
+		if err != nil {
+			return err
+		}
+		defer ix.Close()
+		results, err := ix.Find(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			fmt.Printf("%-8d %s\n", r.N, r.T)
+		}
+		return nil
+	},
+}
+
 var dexUpdateCmd = &Z.Cmd{
 	Name:     `update`,
 	Commands: []*Z.Cmd{help.Cmd},
@@ -368,16 +523,17 @@ var initCmd = &Z.Cmd{
 var editCmd = &Z.Cmd{
 	Name:     `edit`,
 	Aliases:  []string{`e`},
-	Usage:    `(help|INTEGER_NODE_ID|last|TITLEWORD)`,
+	Usage:    `(help|INTEGER_NODE_ID|last|[--tag TAG] [--linked-by ID] [--orphan] [--since WHEN] TITLEWORD)`,
 	Summary:  `choose and edit a specific node (default)`,
 	Commands: []*Z.Cmd{help.Cmd},
 
 	Call: func(x *Z.Cmd, args ...string) error {
+		args, opts := extractFilterFlags(args)
 		if len(args) == 0 {
 			return help.Cmd.Call(x, args...)
 		}
 		if !term.IsInteractive() {
-			return titleCmd.Call(x, args...)
+			return titleCmd.Call(x, append(opts.Flags(), args...)...)
 		}
 		keg, err := current(x.Caller)
 		if err != nil {
@@ -395,6 +551,10 @@ var editCmd = &Z.Cmd{
 				if err != nil {
 					return err
 				}
+				dex, err = filterDex(keg.Path, dex, opts)
+				if err != nil {
+					return err
+				}
 				key := strings.Join(args, " ")
 				choice := dex.ChooseWithTitleText(key)
 				if choice == nil {
@@ -404,22 +564,47 @@ var editCmd = &Z.Cmd{
 			}
 		}
 		path := filepath.Join(keg.Path, id, `README.md`)
+		if IsEncrypted(keg.Path, id) {
+			if err := EditEncrypted(keg.Path, id); err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(id)
+			if err := DexUpdate(keg.Path, &DexEntry{N: n}); err != nil {
+				return err
+			}
+			if ix, err := OpenIndex(keg.Path); err == nil {
+				ix.IndexNode(keg.Path, n)
+				ix.Close()
+			}
+			return nil
+		}
 		if !fs.Exists(path) {
 			return fmt.Errorf("content node (%s) does not exist in %q", id, keg.Name)
 		}
 		if err := file.Edit(path); err != nil {
 			return err
 		}
-		if file.IsEmpty(path) {
+		deleted := file.IsEmpty(path)
+		n, _ := strconv.Atoi(id)
+		if deleted {
 			if err = os.RemoveAll(filepath.Dir(path)); err != nil {
 				return err
 			}
-		}
-		// FIXME: shouldn't make the entire dex every time
-		if err := MakeDex(keg.Path); err != nil {
+			if err := DexRemove(keg.Path, n); err != nil {
+				return err
+			}
+		} else if err := DexUpdate(keg.Path, &DexEntry{N: n}); err != nil {
 			return err
 		}
-		return Publish(keg.Path)
+		if ix, err := OpenIndex(keg.Path); err == nil {
+			if deleted {
+				ix.RemoveNode(n)
+			} else {
+				ix.IndexNode(keg.Path, n)
+			}
+			ix.Close()
+		}
+		return nil
 	},
 }
 
@@ -447,10 +632,24 @@ var createCmd = &Z.Cmd{
 		if err := Edit(keg.Path, entry.N); err != nil {
 			return err
 		}
+		if cfg, err := ReadEncryptConfig(keg.Path); err == nil {
+			id := strconv.Itoa(entry.N)
+			if buf, err := os.ReadFile(plainPath(keg.Path, id)); err == nil {
+				if cfg.matchesEncrypt(ParseFrontmatter(string(buf)).Tags) {
+					if err := EncryptNode(keg.Path, id, cfg); err != nil {
+						return err
+					}
+				}
+			}
+		}
 		if err := DexUpdate(keg.Path, entry); err != nil {
 			return err
 		}
-		return Publish(keg.Path)
+		if ix, err := OpenIndex(keg.Path); err == nil {
+			ix.IndexNode(keg.Path, entry.N)
+			ix.Close()
+		}
+		return nil
 	},
 }
 
@@ -510,9 +709,8 @@ var nodeParseCmd = &Z.Cmd{
 var randomCmd = &Z.Cmd{
 	Name:     `random`,
 	Aliases:  []string{`rand`},
-	Usage:    `[help|title|id|dir|edit]`,
+	Usage:    `[help|title|id|dir|edit] [--tag TAG] [--linked-by ID] [--orphan] [--since WHEN]`,
 	Params:   []string{`title`, `id`, `dir`, `edit`},
-	MaxArgs:  1,
 	Summary:  `return random node, gamify content editing`,
 	Commands: []*Z.Cmd{help.Cmd},
 
@@ -532,6 +730,7 @@ var randomCmd = &Z.Cmd{
 	`,
 
 	Call: func(x *Z.Cmd, args ...string) error {
+		args, opts := extractFilterFlags(args)
 		if len(args) == 0 {
 			args = append(args, `edit`)
 		}
@@ -540,7 +739,17 @@ var randomCmd = &Z.Cmd{
 			return err
 		}
 		dex, err := ReadDex(keg.Path)
+		if err != nil {
+			return err
+		}
+		dex, err = filterDex(keg.Path, dex, opts)
+		if err != nil {
+			return err
+		}
 		r := dex.Random()
+		if r == nil {
+			return fmt.Errorf("no nodes match those filters")
+		}
 		switch args[0] {
 		case `id`:
 			term.Print(r.N)
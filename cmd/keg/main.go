@@ -0,0 +1,8 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import keg "github.com/rwxrob/keg"
+
+func main() { keg.Cmd.Run() }
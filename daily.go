@@ -0,0 +1,291 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	Z "github.com/rwxrob/bonzai/z"
+	"github.com/rwxrob/fs"
+	"github.com/rwxrob/fs/file"
+	"github.com/rwxrob/help"
+	"github.com/rwxrob/vars"
+)
+
+//go:embed testdata/templates/daily.md
+var DefaultDailyTemplate string
+
+const dailyDateFormat = `2006-01-02`
+
+// defaultDailyTitlePattern is the fallback used to recognize a daily
+// node by its title when it carries no date: frontmatter field, and
+// when no title_pattern var has been set. %s is replaced with the
+// node's date in dailyDateFormat. New nodes are not named from the
+// pattern; their heading comes from the daily template.
+const defaultDailyTitlePattern = `Journal %s`
+
+var dailyCmd = &Z.Cmd{
+	Name:     `daily`,
+	Aliases:  []string{`journal`},
+	Usage:    `[--date YYYY-MM-DD|--yesterday|+N|-N]`,
+	Summary:  `open (or create) today's daily node`,
+	UseVars:  true,
+	Commands: []*Z.Cmd{help.Cmd, vars.Cmd},
+	Shortcuts: Z.ArgMap{
+		`pattern`: {`var`, `get`, `title_pattern`},
+		`set`:     {`var`, `set`, `title_pattern`},
+	},
+
+	Description: `
+		The {{aka}} command opens today's daily node, creating it first
+		if it doesn't exist yet. The target day defaults to today and can
+		be changed with {{pre "--date YYYY-MM-DD"}}, {{pre "--yesterday"}},
+		or a relative offset such as {{pre "+1"}} (tomorrow) or {{pre
+		"-7"}} (a week ago).
+
+		An existing daily node is matched by a {{pre "date:"}}
+		frontmatter field, falling back to the title pattern {{pre
+		"Journal YYYY-MM-DD"}} (override with {{pre "daily set PATTERN"}},
+		where {{pre "%s"}} in PATTERN is replaced with the date). A new
+		node is seeded from {{pre "<keg>/templates/daily.md"}} (or a
+		built-in template if that file doesn't exist) and automatically
+		cross-linked to the daily nodes immediately before and after it.
+
+	`,
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		keg, err := current(x.Caller)
+		if err != nil {
+			return err
+		}
+		pattern := defaultDailyTitlePattern
+		if p, err := x.Get(`title_pattern`); err == nil && p != "" {
+			pattern = p
+		}
+		date, err := resolveDailyDate(args)
+		if err != nil {
+			return err
+		}
+
+		found, err := findDailyNode(keg.Path, date, pattern)
+		if err != nil {
+			return err
+		}
+		if found != nil {
+			return editCmd.Call(x, strconv.Itoa(found.N))
+		}
+
+		entry, err := MakeNode(keg.Path)
+		if err != nil {
+			return err
+		}
+
+		content, prev, next, err := renderDailyTemplate(keg.Path, date, pattern)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(keg.Path, strconv.Itoa(entry.N), `README.md`)
+		if err := file.Overwrite(path, content); err != nil {
+			return err
+		}
+		if prev != nil {
+			linkDailyNeighbor(keg.Path, prev.N, entry.N, `next`)
+		}
+		if next != nil {
+			linkDailyNeighbor(keg.Path, next.N, entry.N, `prev`)
+		}
+
+		if err := Edit(keg.Path, entry.N); err != nil {
+			return err
+		}
+		if err := DexUpdate(keg.Path, entry); err != nil {
+			return err
+		}
+		if ix, err := OpenIndex(keg.Path); err == nil {
+			ix.IndexNode(keg.Path, entry.N)
+			ix.Close()
+		}
+		return nil
+	},
+}
+
+// resolveDailyDate parses the --date, --yesterday, and +N/-N forms
+// accepted by dailyCmd and returns the resulting calendar day at
+// midnight UTC. With no arguments it resolves to today.
+func resolveDailyDate(args []string) (time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if len(args) == 0 {
+		return today, nil
+	}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case `--date`:
+			if i+1 >= len(args) {
+				return today, fmt.Errorf("--date requires a YYYY-MM-DD argument")
+			}
+			return time.Parse(dailyDateFormat, args[i+1])
+		case `--yesterday`:
+			return today.AddDate(0, 0, -1), nil
+		default:
+			if n, err := strconv.Atoi(args[i]); err == nil {
+				return today.AddDate(0, 0, n), nil
+			}
+		}
+	}
+	return today, nil
+}
+
+// dailyMatch is an existing daily node found by findDailyNode.
+type dailyMatch struct {
+	N    int
+	Date string
+}
+
+// findDailyNode scans every node in kegdir for one whose date:
+// frontmatter field (or, failing that, its title against pattern)
+// matches date, returning nil if none is found.
+func findDailyNode(kegdir string, date time.Time, pattern string) (*dailyMatch, error) {
+	want := date.Format(dailyDateFormat)
+	wantTitle := strings.ToLower(fmt.Sprintf(pattern, want))
+
+	entries, err := os.ReadDir(kegdir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(kegdir, e.Name(), `README.md`)
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		fm := ParseFrontmatter(string(buf))
+		if fm.Fields[`date`] == want {
+			return &dailyMatch{N: id, Date: want}, nil
+		}
+		if strings.ToLower(firstLine(fm.Body)) == wantTitle {
+			return &dailyMatch{N: id, Date: want}, nil
+		}
+	}
+	return nil, nil
+}
+
+// nearestDailyNode finds the closest existing daily node to date in
+// the given direction (-1 for before, +1 for after), searching up to
+// a year out before giving up.
+func nearestDailyNode(kegdir string, date time.Time, direction int, pattern string) (*dailyMatch, error) {
+	d := date
+	for i := 0; i < 366; i++ {
+		d = d.AddDate(0, 0, direction)
+		m, err := findDailyNode(kegdir, d, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// dailyTemplateData is the set of substitutions available to
+// templates/daily.md.
+type dailyTemplateData struct {
+	Date    string
+	Weekday string
+	PrevID  string
+	NextID  string
+}
+
+// renderDailyTemplate loads <kegdir>/templates/daily.md (or falls
+// back to DefaultDailyTemplate) and executes it against date, with
+// PrevID/NextID resolved from the nearest existing daily nodes
+// (matched per pattern). The matched prev/next nodes are returned so
+// the caller can link them back to the node being created.
+func renderDailyTemplate(kegdir string, date time.Time, pattern string) (content string, prev, next *dailyMatch, err error) {
+	tmplText := DefaultDailyTemplate
+	custom := filepath.Join(kegdir, `templates`, `daily.md`)
+	if fs.Exists(custom) {
+		buf, err := os.ReadFile(custom)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		tmplText = string(buf)
+	}
+
+	tmpl, err := template.New(`daily`).Parse(tmplText)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	data := dailyTemplateData{
+		Date:    date.Format(dailyDateFormat),
+		Weekday: date.Format(`Monday`),
+	}
+	prev, err = nearestDailyNode(kegdir, date, -1, pattern)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if prev != nil {
+		data.PrevID = strconv.Itoa(prev.N)
+	}
+	next, err = nearestDailyNode(kegdir, date, 1, pattern)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if next != nil {
+		data.NextID = strconv.Itoa(next.N)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", nil, nil, err
+	}
+	return out.String(), prev, next, nil
+}
+
+// linkDailyNeighbor appends a "< [prev](/N)" or "[next](/N)" line to
+// an existing daily node's README.md so that creating a new daily
+// note updates its neighbors too, not just itself, and reindexes the
+// neighbor so its new outgoing link is immediately visible to
+// --linked-by. It is a no-op if the link is already present.
+func linkDailyNeighbor(kegdir string, id, newID int, direction string) {
+	path := filepath.Join(kegdir, strconv.Itoa(id), `README.md`)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	link := fmt.Sprintf(`(/%d)`, newID)
+	if strings.Contains(string(buf), link) {
+		return
+	}
+	var line string
+	switch direction {
+	case `next`:
+		line = fmt.Sprintf("\n[next](/%d)\n", newID)
+	case `prev`:
+		line = fmt.Sprintf("\n< [prev](/%d)\n", newID)
+	}
+	if err := file.Overwrite(path, strings.TrimRight(string(buf), "\n")+"\n"+line); err != nil {
+		return
+	}
+	DexUpdate(kegdir, &DexEntry{N: id})
+	if ix, err := OpenIndex(kegdir); err == nil {
+		ix.IndexNode(kegdir, id)
+		ix.Close()
+	}
+}
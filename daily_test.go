@@ -0,0 +1,92 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestResolveDailyDate(t *testing.T) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	cases := []struct {
+		name string
+		args []string
+		want time.Time
+	}{
+		{name: `no args defaults to today`, args: nil, want: today},
+		{name: `--date parses an absolute day`, args: []string{`--date`, `2023-01-02`}, want: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{name: `--yesterday`, args: []string{`--yesterday`}, want: today.AddDate(0, 0, -1)},
+		{name: `+N is N days from today`, args: []string{`+3`}, want: today.AddDate(0, 0, 3)},
+		{name: `-N is N days before today`, args: []string{`-2`}, want: today.AddDate(0, 0, -2)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := resolveDailyDate(c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestResolveDailyDateMissingArg(t *testing.T) {
+	if _, err := resolveDailyDate([]string{`--date`}); err == nil {
+		t.Error("expected an error for --date with no argument")
+	}
+}
+
+func writeNode(t *testing.T, kegdir string, id int, body string) {
+	t.Helper()
+	dir := filepath.Join(kegdir, strconv.Itoa(id))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, `README.md`), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindDailyNode(t *testing.T) {
+	kegdir := t.TempDir()
+	date := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	writeNode(t, kegdir, 0, "Unrelated\n")
+	writeNode(t, kegdir, 1, "---\ndate: 2023-06-01\n---\n# Some Title\n")
+
+	got, err := findDailyNode(kegdir, date, defaultDailyTitlePattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.N != 1 {
+		t.Fatalf("got %+v, want match on node 1", got)
+	}
+
+	if got, err := findDailyNode(kegdir, date.AddDate(0, 0, 1), defaultDailyTitlePattern); err != nil || got != nil {
+		t.Fatalf("got %+v, %v; want no match for an unrelated date", got, err)
+	}
+}
+
+func TestFindDailyNodeByTitlePattern(t *testing.T) {
+	kegdir := t.TempDir()
+	date := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	writeNode(t, kegdir, 2, "# Journal 2023-06-01\n")
+
+	got, err := findDailyNode(kegdir, date, defaultDailyTitlePattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.N != 2 {
+		t.Fatalf("got %+v, want match on node 2 by title pattern", got)
+	}
+}
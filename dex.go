@@ -0,0 +1,296 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwxrob/fs/file"
+)
+
+// DexEntry is a single row of a Dex: a node's id, title, and the time
+// it was last updated.
+type DexEntry struct {
+	N int
+	T string
+	U string // time.RFC3339
+}
+
+// ID returns the entry's node id as a string, the form used in
+// filesystem paths and links.
+func (e *DexEntry) ID() string { return strconv.Itoa(e.N) }
+
+// Dex is an ordered index of node entries, the in-memory form of
+// dex/nodes.tsv and dex/latest.md.
+type Dex struct{ Items []*DexEntry }
+
+// ParseDex parses tab-separated "id\ttitle\tupdated" lines (the
+// format written by MakeDex) into a Dex.
+func ParseDex(text string) (*Dex, error) {
+	dex := &Dex{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		n, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		entry := &DexEntry{N: n, T: parts[1]}
+		if len(parts) > 2 {
+			entry.U = parts[2]
+		}
+		dex.Items = append(dex.Items, entry)
+	}
+	return dex, nil
+}
+
+// ReadDex reads and parses dex/nodes.tsv from kegdir.
+func ReadDex(kegdir string) (*Dex, error) {
+	buf, err := os.ReadFile(filepath.Join(kegdir, `dex`, `nodes.tsv`))
+	if err != nil {
+		return nil, err
+	}
+	return ParseDex(string(buf))
+}
+
+// String renders dex back into the tab-separated form ParseDex reads.
+func (d *Dex) String() string {
+	var b strings.Builder
+	for _, e := range d.Items {
+		fmt.Fprintf(&b, "%d\t%s\t%s\n", e.N, e.T, e.U)
+	}
+	return b.String()
+}
+
+// WithTitleText returns the subset of d whose title contains str
+// (case-insensitively). An empty str matches every entry.
+func (d *Dex) WithTitleText(str string) *Dex {
+	if str == "" {
+		return d
+	}
+	low := strings.ToLower(str)
+	out := &Dex{}
+	for _, e := range d.Items {
+		if strings.Contains(strings.ToLower(e.T), low) {
+			out.Items = append(out.Items, e)
+		}
+	}
+	return out
+}
+
+// WithIDs returns the subset of d whose node id is in ids, preserving
+// d's existing order. It is the primitive behind the --tag,
+// --linked-by, --orphan, and --since filters, which resolve a set of
+// matching ids from the SQLite index and then narrow the TSV dex down
+// to just those.
+func (d *Dex) WithIDs(ids map[int]bool) *Dex {
+	out := &Dex{}
+	for _, e := range d.Items {
+		if ids[e.N] {
+			out.Items = append(out.Items, e)
+		}
+	}
+	return out
+}
+
+// ChooseWithTitleText returns the first entry whose title contains
+// str, or nil if none match.
+func (d *Dex) ChooseWithTitleText(str string) *DexEntry {
+	matches := d.WithTitleText(str)
+	if len(matches.Items) == 0 {
+		return nil
+	}
+	return matches.Items[0]
+}
+
+// Random returns a random entry from d, or nil if d is empty.
+func (d *Dex) Random() *DexEntry {
+	if len(d.Items) == 0 {
+		return nil
+	}
+	return d.Items[rand.Intn(len(d.Items))]
+}
+
+// AsIncludes renders d as KEGML :include directives, one per entry,
+// suitable for piping into another tool.
+func (d *Dex) AsIncludes() string {
+	var b strings.Builder
+	for _, e := range d.Items {
+		fmt.Fprintf(&b, ":include %d\n", e.N)
+	}
+	return b.String()
+}
+
+// Pretty renders d as a human-readable id/title table for interactive
+// terminals.
+func (d *Dex) Pretty() string {
+	var b strings.Builder
+	for _, e := range d.Items {
+		fmt.Fprintf(&b, "%-8d %s\n", e.N, e.T)
+	}
+	return b.String()
+}
+
+// buildDexEntry reads node id from kegdir and builds the DexEntry
+// that belongs in the dex for it. included is false when the node
+// must not appear in the dex at all (an encrypted node in a keg
+// configured with dex_public: true); when included is true but the
+// node is encrypted, the returned entry carries an empty title so the
+// plaintext is never written to dex/nodes.tsv or dex/latest.md.
+func buildDexEntry(kegdir string, id int, cfg *EncryptConfig) (entry *DexEntry, included bool, err error) {
+	idStr := strconv.Itoa(id)
+
+	if IsEncrypted(kegdir, idStr) {
+		if cfg != nil && cfg.DexPublic {
+			return nil, false, nil
+		}
+		info, err := os.Stat(encryptedPath(kegdir, idStr))
+		if err != nil {
+			return nil, false, err
+		}
+		return &DexEntry{N: id, U: info.ModTime().UTC().Format(time.RFC3339)}, true, nil
+	}
+
+	path := plainPath(kegdir, idStr)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	title := firstLine(ParseFrontmatter(string(buf)).Body)
+	return &DexEntry{
+		N: id,
+		T: title,
+		U: info.ModTime().UTC().Format(time.RFC3339),
+	}, true, nil
+}
+
+// scanDex walks every node directory under kegdir and builds the Dex
+// that should result, honoring each node's encryption status per cfg.
+func scanDex(kegdir string) (*Dex, error) {
+	cfg, err := ReadEncryptConfig(kegdir)
+	if err != nil {
+		cfg = &EncryptConfig{}
+	}
+	entries, err := os.ReadDir(kegdir)
+	if err != nil {
+		return nil, err
+	}
+	dex := &Dex{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		entry, included, err := buildDexEntry(kegdir, id, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %w", id, err)
+		}
+		if !included {
+			continue
+		}
+		dex.Items = append(dex.Items, entry)
+	}
+	sort.Slice(dex.Items, func(i, j int) bool { return dex.Items[i].N < dex.Items[j].N })
+	return dex, nil
+}
+
+// MakeDex rebuilds dex/nodes.tsv and dex/latest.md from scratch by
+// scanning every node in kegdir. Encrypted nodes are represented by id
+// only (never their plaintext title), or omitted entirely when the
+// keg is configured with dex_public: true. Day-to-day edits should go
+// through DexUpdate instead, which updates a single entry in place.
+func MakeDex(kegdir string) error {
+	dex, err := scanDex(kegdir)
+	if err != nil {
+		return err
+	}
+	return writeDex(kegdir, dex)
+}
+
+func writeDex(kegdir string, dex *Dex) error {
+	if err := file.Overwrite(filepath.Join(kegdir, `dex`, `nodes.tsv`), dex.String()); err != nil {
+		return err
+	}
+	latest := &Dex{Items: append([]*DexEntry{}, dex.Items...)}
+	sort.Slice(latest.Items, func(i, j int) bool { return latest.Items[i].U > latest.Items[j].U })
+	return file.Overwrite(filepath.Join(kegdir, `dex`, `latest.md`), latest.String())
+}
+
+// DexUpdate incrementally updates a single node's row in dex/nodes.tsv
+// and dex/latest.md, re-deriving the entry straight from disk (so the
+// encryption rules in buildDexEntry always apply) rather than
+// rewriting the entire dex the way MakeDex does.
+func DexUpdate(kegdir string, entry *DexEntry) error {
+	cfg, err := ReadEncryptConfig(kegdir)
+	if err != nil {
+		cfg = &EncryptConfig{}
+	}
+	fresh, included, err := buildDexEntry(kegdir, entry.N, cfg)
+	if err != nil {
+		return err
+	}
+
+	dex, err := ReadDex(kegdir)
+	if err != nil {
+		dex = &Dex{}
+	}
+	filtered := dex.Items[:0]
+	for _, e := range dex.Items {
+		if e.N != entry.N {
+			filtered = append(filtered, e)
+		}
+	}
+	dex.Items = filtered
+	if included {
+		dex.Items = append(dex.Items, fresh)
+	}
+	sort.Slice(dex.Items, func(i, j int) bool { return dex.Items[i].N < dex.Items[j].N })
+
+	return writeDex(kegdir, dex)
+}
+
+// DexRemove removes a single node's row from dex/nodes.tsv and
+// dex/latest.md in place, the incremental counterpart to DexUpdate
+// used once a node's directory no longer exists on disk.
+func DexRemove(kegdir string, id int) error {
+	dex, err := ReadDex(kegdir)
+	if err != nil {
+		return err
+	}
+	filtered := dex.Items[:0]
+	for _, e := range dex.Items {
+		if e.N != id {
+			filtered = append(filtered, e)
+		}
+	}
+	dex.Items = filtered
+	return writeDex(kegdir, dex)
+}
+
+// Publish republishes the dex, which today just means rewriting
+// dex/nodes.tsv and dex/latest.md via MakeDex so that the encryption
+// rules in buildDexEntry are re-applied to whatever is on disk.
+func Publish(kegdir string) error {
+	return MakeDex(kegdir)
+}
@@ -0,0 +1,344 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	Z "github.com/rwxrob/bonzai/z"
+	"github.com/rwxrob/fs"
+	"github.com/rwxrob/fs/file"
+	"github.com/rwxrob/help"
+
+	"filippo.io/age"
+	xterm "golang.org/x/term"
+)
+
+// EncryptConfig is the subset of the keg YAML info file that controls
+// per-node encryption: which nodes to encrypt, who can decrypt them,
+// and whether they should still appear (by id only) in the public
+// dex.
+type EncryptConfig struct {
+	Recipients []string // age X25519 public keys (age1...)
+	Encrypt    string   // glob matched against a node's tags, e.g. "private*"
+	DexPublic  bool     // if true, encrypted nodes are omitted from the dex entirely
+}
+
+// ReadEncryptConfig parses the recipients:, encrypt:, and dex_public:
+// fields out of kegdir's keg YAML info file. A keg with none of those
+// fields set returns a zero EncryptConfig and no error, so calling
+// this on a keg with no encryption configured is always safe.
+func ReadEncryptConfig(kegdir string) (*EncryptConfig, error) {
+	buf, err := os.ReadFile(filepath.Join(kegdir, `keg`))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &EncryptConfig{}
+	lines := strings.Split(string(buf), "\n")
+	inRecipients := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		low := strings.ToLower(trimmed)
+		switch {
+		case strings.HasPrefix(low, `recipients:`):
+			rest := strings.TrimSpace(trimmed[len(`recipients:`):])
+			inRecipients = rest == ""
+			if !inRecipients && rest != "" {
+				for _, r := range strings.Split(strings.Trim(rest, `[]`), `,`) {
+					r = strings.Trim(strings.TrimSpace(r), `"'`)
+					if r != "" {
+						cfg.Recipients = append(cfg.Recipients, r)
+					}
+				}
+			}
+		case inRecipients && strings.HasPrefix(trimmed, `-`):
+			r := strings.Trim(strings.TrimSpace(trimmed[1:]), `"'`)
+			if r != "" {
+				cfg.Recipients = append(cfg.Recipients, r)
+			}
+		case strings.HasPrefix(low, `encrypt:`):
+			inRecipients = false
+			cfg.Encrypt = strings.Trim(strings.TrimSpace(trimmed[len(`encrypt:`):]), `"'`)
+		case strings.HasPrefix(low, `dex_public:`):
+			inRecipients = false
+			cfg.DexPublic = strings.TrimSpace(trimmed[len(`dex_public:`):]) == `true`
+		default:
+			inRecipients = false
+		}
+	}
+	return cfg, nil
+}
+
+// matchesEncrypt reports whether any of tags glob-matches cfg.Encrypt.
+func (cfg *EncryptConfig) matchesEncrypt(tags []string) bool {
+	if cfg == nil || cfg.Encrypt == "" {
+		return false
+	}
+	for _, tag := range tags {
+		if ok, _ := filepath.Match(cfg.Encrypt, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func encryptedPath(kegdir, id string) string {
+	return filepath.Join(kegdir, id, `README.md.age`)
+}
+
+func plainPath(kegdir, id string) string {
+	return filepath.Join(kegdir, id, `README.md`)
+}
+
+// IsEncrypted reports whether node id in kegdir is stored as
+// README.md.age instead of (or alongside) a plaintext README.md.
+func IsEncrypted(kegdir, id string) bool {
+	return fs.Exists(encryptedPath(kegdir, id))
+}
+
+// ageRecipients parses cfg.Recipients as X25519 public keys, prompting
+// for a passphrase to use as a scrypt recipient instead when none are
+// configured.
+func ageRecipients(cfg *EncryptConfig) ([]age.Recipient, error) {
+	if len(cfg.Recipients) > 0 {
+		recipients := make([]age.Recipient, 0, len(cfg.Recipients))
+		for _, r := range cfg.Recipients {
+			rec, err := age.ParseX25519Recipient(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipient %q: %w", r, err)
+			}
+			recipients = append(recipients, rec)
+		}
+		return recipients, nil
+	}
+	pass, err := readPassphrase(`Passphrase: `)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := age.NewScryptRecipient(pass)
+	if err != nil {
+		return nil, err
+	}
+	return []age.Recipient{rec}, nil
+}
+
+// ageIdentities resolves the identities available to decrypt with: an
+// identity file named by $KEG_AGE_IDENTITY if set, falling back to a
+// passphrase prompt for scrypt-encrypted nodes.
+func ageIdentities() ([]age.Identity, error) {
+	path := os.Getenv(`KEG_AGE_IDENTITY`)
+	if path == "" {
+		pass, err := readPassphrase(`Passphrase: `)
+		if err != nil {
+			return nil, err
+		}
+		id, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{id}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
+
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	buf, err := xterm.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// EncryptNode age-encrypts node id's plaintext README.md into
+// README.md.age and removes the plaintext, using cfg's recipients (or
+// a passphrase if none are configured).
+func EncryptNode(kegdir, id string, cfg *EncryptConfig) error {
+	plain, err := os.ReadFile(plainPath(kegdir, id))
+	if err != nil {
+		return err
+	}
+	recipients, err := ageRecipients(cfg)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := file.Overwrite(encryptedPath(kegdir, id), out.String()); err != nil {
+		return err
+	}
+	return os.Remove(plainPath(kegdir, id))
+}
+
+// DecryptPlaintext returns the decrypted contents of node id's
+// README.md.age without writing anything to disk.
+func DecryptPlaintext(kegdir, id string) (string, error) {
+	f, err := os.Open(encryptedPath(kegdir, id))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	identities, err := ageIdentities()
+	if err != nil {
+		return "", err
+	}
+	r, err := age.Decrypt(f, identities...)
+	if err != nil {
+		return "", err
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// DecryptNode migrates node id from README.md.age back to a plaintext
+// README.md.
+func DecryptNode(kegdir, id string) error {
+	plain, err := DecryptPlaintext(kegdir, id)
+	if err != nil {
+		return err
+	}
+	if err := file.Overwrite(plainPath(kegdir, id), plain); err != nil {
+		return err
+	}
+	return os.Remove(encryptedPath(kegdir, id))
+}
+
+// EditEncrypted decrypts node id to a temporary file, opens it with
+// $EDITOR, and re-encrypts the result back into README.md.age on
+// save, so an encrypted node is never written to disk in plaintext
+// outside of the editing session.
+func EditEncrypted(kegdir, id string) error {
+	plain, err := DecryptPlaintext(kegdir, id)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", `keg-*-README.md`)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmp.WriteString(plain); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := file.Edit(tmpPath); err != nil {
+		return err
+	}
+
+	edited, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := ReadEncryptConfig(kegdir)
+	if err != nil {
+		return err
+	}
+	recipients, err := ageRecipients(cfg)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(edited); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return file.Overwrite(encryptedPath(kegdir, id), out.String())
+}
+
+var encryptCmd = &Z.Cmd{
+	Name:     `encrypt`,
+	Usage:    `INTEGER_NODE_ID`,
+	Summary:  `migrate a node to age-encrypted storage`,
+	Commands: []*Z.Cmd{help.Cmd},
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		if len(args) == 0 {
+			return x.UsageError()
+		}
+		keg, err := current(x.Caller)
+		if err != nil {
+			return err
+		}
+		cfg, err := ReadEncryptConfig(keg.Path)
+		if err != nil {
+			return err
+		}
+		if err := EncryptNode(keg.Path, args[0], cfg); err != nil {
+			return err
+		}
+		if err := MakeDex(keg.Path); err != nil {
+			return err
+		}
+		if ix, err := OpenIndex(keg.Path); err == nil {
+			n, _ := strconv.Atoi(args[0])
+			ix.IndexNode(keg.Path, n)
+			ix.Close()
+		}
+		return Publish(keg.Path)
+	},
+}
+
+var decryptCmd = &Z.Cmd{
+	Name:     `decrypt`,
+	Usage:    `INTEGER_NODE_ID`,
+	Summary:  `migrate a node back to plaintext storage`,
+	Commands: []*Z.Cmd{help.Cmd},
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		if len(args) == 0 {
+			return x.UsageError()
+		}
+		keg, err := current(x.Caller)
+		if err != nil {
+			return err
+		}
+		if err := DecryptNode(keg.Path, args[0]); err != nil {
+			return err
+		}
+		if err := MakeDex(keg.Path); err != nil {
+			return err
+		}
+		if ix, err := OpenIndex(keg.Path); err == nil {
+			n, _ := strconv.Atoi(args[0])
+			ix.IndexNode(keg.Path, n)
+			ix.Close()
+		}
+		return Publish(keg.Path)
+	},
+}
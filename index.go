@@ -0,0 +1,340 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Index wraps a SQLite database (dex/index.db) that shadows
+// dex/nodes.tsv and dex/latest.md with a queryable, incrementally
+// updated store: node id, title, mtime, tags, links, and the full
+// body text (searchable via FTS5). It exists so that commands like
+// find and the --tag/--linked-by/--orphan/--since filters don't have
+// to linear-scan the TSV dex on every invocation.
+type Index struct{ db *sql.DB }
+
+const indexSchema = `
+create table if not exists nodes (
+	id    integer primary key,
+	title text not null default '',
+	mtime text not null default ''
+);
+create table if not exists tags (
+	node_id integer not null,
+	tag     text not null
+);
+create table if not exists links (
+	src integer not null,
+	dst integer not null
+);
+create virtual table if not exists body using fts5(
+	node_id unindexed, title, body, tokenize = 'porter'
+);
+create index if not exists tags_tag on tags(tag);
+create index if not exists tags_node on tags(node_id);
+create index if not exists links_src on links(src);
+create index if not exists links_dst on links(dst);
+`
+
+// indexPath returns the location of the SQLite database for kegdir.
+func indexPath(kegdir string) string {
+	return filepath.Join(kegdir, `dex`, `index.db`)
+}
+
+// OpenIndex opens (creating if needed) the SQLite index for the keg
+// rooted at kegdir and ensures its schema is current.
+func OpenIndex(kegdir string) (*Index, error) {
+	if err := os.MkdirAll(filepath.Join(kegdir, `dex`), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(`sqlite`, indexPath(kegdir))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(indexSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Index{db: db}, nil
+}
+
+// Close releases the underlying database handle.
+func (ix *Index) Close() error { return ix.db.Close() }
+
+var linkRE = regexp.MustCompile(`\]\(/(\d+)\)`)
+
+// extractLinks returns the node ids of every [title](/N) link found
+// in body.
+func extractLinks(body string) []int {
+	var out []int
+	for _, m := range linkRE.FindAllStringSubmatch(body, -1) {
+		n, err := strconv.Atoi(m[1])
+		if err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// IndexNode reads the node identified by id from kegdir and upserts
+// its title, mtime, tags, links, and body into the index. It is safe
+// to call repeatedly; each call fully replaces that node's rows.
+func (ix *Index) IndexNode(kegdir string, id int) error {
+	idStr := strconv.Itoa(id)
+	dir := filepath.Join(kegdir, idStr)
+	path := filepath.Join(dir, `README.md`)
+
+	var raw string
+	if IsEncrypted(kegdir, idStr) {
+		// Decrypted only in memory for indexing: the plaintext title,
+		// tags, and body never touch dex/nodes.tsv or dex/latest.md, and
+		// here they only ever reach the local SQLite index.
+		plain, err := DecryptPlaintext(kegdir, idStr)
+		if err != nil {
+			return ix.indexEncryptedOnly(kegdir, id)
+		}
+		raw = plain
+		path = encryptedPath(kegdir, idStr)
+	} else {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		raw = string(buf)
+	}
+	fm := ParseFrontmatter(raw)
+	body := fm.Body
+	title := body
+	if i := strings.Index(body, "\n"); i >= 0 {
+		title = body[:i]
+	}
+	title = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(title), `#`))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	mtime := info.ModTime().UTC().Format(time.RFC3339)
+
+	if err := ix.RemoveNode(id); err != nil {
+		return err
+	}
+
+	tx, err := ix.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`insert into nodes (id, title, mtime) values (?, ?, ?)`,
+		id, title, mtime); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`insert into body (node_id, title, body) values (?, ?, ?)`,
+		id, title, body); err != nil {
+		return err
+	}
+	for _, tag := range fm.Tags {
+		if _, err := tx.Exec(`insert into tags (node_id, tag) values (?, ?)`,
+			id, tag); err != nil {
+			return err
+		}
+	}
+	for _, dst := range extractLinks(body) {
+		if _, err := tx.Exec(`insert into links (src, dst) values (?, ?)`,
+			id, dst); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// indexEncryptedOnly records just the id of an encrypted node whose
+// contents couldn't be decrypted (no identity or passphrase
+// available), so it still shows up in --orphan/--since scans without
+// leaking its title.
+func (ix *Index) indexEncryptedOnly(kegdir string, id int) error {
+	var mtime string
+	if info, err := os.Stat(encryptedPath(kegdir, strconv.Itoa(id))); err == nil {
+		mtime = info.ModTime().UTC().Format(time.RFC3339)
+	}
+	if err := ix.RemoveNode(id); err != nil {
+		return err
+	}
+	_, err := ix.db.Exec(`insert into nodes (id, title, mtime) values (?, '', ?)`, id, mtime)
+	return err
+}
+
+// RemoveNode deletes every row that id owns from the index: its node,
+// body, and tag rows and its outgoing links. Links from other nodes
+// into id belong to those nodes and are kept. It is used both when a
+// node is deleted and before IndexNode rewrites its rows.
+func (ix *Index) RemoveNode(id int) error {
+	if _, err := ix.db.Exec(`delete from nodes where id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := ix.db.Exec(`delete from body where node_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := ix.db.Exec(`delete from tags where node_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := ix.db.Exec(`delete from links where src = ?`, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Rebuild clears dex/index.db and reindexes every node directory
+// under kegdir from scratch, so zombie rows for ids no longer on disk
+// (left over from a bug, or a node deleted outside of keg delete)
+// don't linger forever. Use this to recover from a corrupt or missing
+// dex/index.db; day to day updates should go through IndexNode and
+// RemoveNode instead.
+func (ix *Index) Rebuild(kegdir string) error {
+	for _, table := range []string{`nodes`, `tags`, `links`, `body`} {
+		if _, err := ix.db.Exec(`delete from ` + table); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(kegdir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if err := ix.IndexNode(kegdir, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchResult is a single match from Find.
+type SearchResult struct {
+	N int
+	T string
+}
+
+// Find runs an FTS5 query (e.g. `find "foo AND bar"`) against node
+// titles and bodies and returns matches ordered by relevance.
+func (ix *Index) Find(query string) ([]SearchResult, error) {
+	rows, err := ix.db.Query(
+		`select node_id, title from body where body match ? order by rank`,
+		query,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.N, &r.T); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// FilterOpts narrows the node ids returned by Filter. Zero values are
+// ignored, so an empty FilterOpts matches every indexed node.
+type FilterOpts struct {
+	Tag      string
+	LinkedBy string // node id (as a string) whose outgoing links to follow
+	Orphan   bool   // only nodes with no incoming links
+	Since    string // RFC3339 or date prefix; only nodes with mtime >= Since
+}
+
+// Flags renders opts back into the --tag/--linked-by/--orphan/--since
+// command-line flags that extractFilterFlags parses, so a command
+// that already stripped them out of args can re-append them when
+// delegating to another command.
+func (opts FilterOpts) Flags() []string {
+	var flags []string
+	if opts.Tag != "" {
+		flags = append(flags, `--tag`, opts.Tag)
+	}
+	if opts.LinkedBy != "" {
+		flags = append(flags, `--linked-by`, opts.LinkedBy)
+	}
+	if opts.Orphan {
+		flags = append(flags, `--orphan`)
+	}
+	if opts.Since != "" {
+		flags = append(flags, `--since`, opts.Since)
+	}
+	return flags
+}
+
+// Filter returns the ids of nodes matching every non-zero field of
+// opts, resolved entirely from the index rather than the TSV dex.
+func (ix *Index) Filter(opts FilterOpts) ([]int, error) {
+	query := `select distinct nodes.id from nodes`
+	var joins []string
+	var where []string
+	var args []any
+
+	if opts.Tag != "" {
+		joins = append(joins, `join tags on tags.node_id = nodes.id`)
+		where = append(where, `tags.tag = ?`)
+		args = append(args, opts.Tag)
+	}
+	if opts.LinkedBy != "" {
+		src, err := strconv.Atoi(opts.LinkedBy)
+		if err != nil {
+			return nil, fmt.Errorf("linked-by must be a node id: %w", err)
+		}
+		joins = append(joins, `join links on links.dst = nodes.id`)
+		where = append(where, `links.src = ?`)
+		args = append(args, src)
+	}
+	if opts.Orphan {
+		where = append(where, `nodes.id not in (select dst from links)`)
+	}
+	if opts.Since != "" {
+		where = append(where, `nodes.mtime >= ?`)
+		args = append(args, opts.Since)
+	}
+
+	if len(joins) > 0 {
+		query += " " + strings.Join(joins, " ")
+	}
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+
+	rows, err := ix.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
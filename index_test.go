@@ -0,0 +1,27 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import "testing"
+
+func TestFilterOptsFlagsRoundTrip(t *testing.T) {
+	cases := []FilterOpts{
+		{},
+		{Tag: `private`},
+		{LinkedBy: `12`},
+		{Orphan: true},
+		{Since: `2023-01-01`},
+		{Tag: `private`, LinkedBy: `12`, Orphan: true, Since: `2023-01-01`},
+	}
+
+	for _, want := range cases {
+		rest, got := extractFilterFlags(want.Flags())
+		if len(rest) != 0 {
+			t.Errorf("extractFilterFlags left over args %v for %+v", rest, want)
+		}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package teshtest runs .tesh shell-transcript files against a built
+// keg binary. A transcript is plain text: lines beginning with "$ "
+// are commands to run, and the lines that follow (up to the next "$ "
+// or end of file) are the output expected from it (stdout and stderr
+// together). A literal
+// "<BLANKLINE>" matches an empty line, and "*" within an expected line
+// is a glob wildcard matched with filepath.Match. This exercises the
+// interactive command surface end to end in a way unit tests can't,
+// since commands like current() resolve relative to $KEG_CURRENT and
+// the process's working directory.
+package teshtest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Update, when set with "-update", rewrites each transcript's expected
+// output in place with what the command actually produced, instead of
+// comparing against it.
+var Update = flag.Bool(`update`, false, `rewrite .tesh expected output in place`)
+
+// Run builds the keg binary once and executes every *.tesh file in
+// dir as its own subtest.
+func Run(t *testing.T, dir string) {
+	t.Helper()
+	bin := buildBinary(t)
+	files, err := filepath.Glob(filepath.Join(dir, `*.tesh`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no .tesh files found in %s", dir)
+	}
+	for _, f := range files {
+		f := f
+		t.Run(filepath.Base(f), func(t *testing.T) { runTranscript(t, bin, f) })
+	}
+}
+
+// buildBinary compiles ./cmd/keg into a temporary directory and
+// returns the path to the resulting executable.
+func buildBinary(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	name := `keg`
+	if runtime.GOOS == `windows` {
+		name += `.exe`
+	}
+	bin := filepath.Join(dir, name)
+	cmd := exec.Command(`go`, `build`, `-o`, bin, `./cmd/keg`)
+	cmd.Dir = moduleRoot(t)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("building keg binary: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// moduleRoot walks up from the package's source directory looking for
+// go.mod so tests work no matter what directory `go test` is invoked
+// from.
+func moduleRoot(t *testing.T) string {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, `go.mod`)); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			t.Fatal("could not find module root (no go.mod found above " + dir + ")")
+		}
+		dir = parent
+	}
+}
+
+// step is one "$ command" plus the raw lines expected to follow it.
+type step struct {
+	cmd      string
+	expected []string
+}
+
+func runTranscript(t *testing.T, bin, path string) {
+	t.Helper()
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf), "\n")
+
+	home := t.TempDir()
+	kegdir := filepath.Join(home, `keg`)
+
+	var steps []step
+	var cur *step
+	// header holds the lines -update keeps verbatim: "# setup:"
+	// directives and anything before the first step.
+	var header []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, `# setup:`):
+			header = append(header, line)
+			fixture := strings.TrimSpace(strings.TrimPrefix(line, `# setup:`))
+			if err := unpackFixture(fixture, kegdir); err != nil {
+				t.Fatalf("setup %s: %v", fixture, err)
+			}
+		case strings.HasPrefix(line, `$ `):
+			if cur != nil {
+				steps = append(steps, *cur)
+			}
+			cur = &step{cmd: strings.TrimPrefix(line, `$ `)}
+		case cur != nil:
+			if i == len(lines)-1 && line == "" {
+				continue // trailing newline at EOF isn't an expectation
+			}
+			cur.expected = append(cur.expected, line)
+		default:
+			header = append(header, line)
+		}
+	}
+	if cur != nil {
+		steps = append(steps, *cur)
+	}
+
+	updated := append(make([]string, 0, len(lines)), header...)
+	for _, st := range steps {
+		actual := runStep(t, bin, home, kegdir, st.cmd)
+		if *Update {
+			updated = append(updated, `$ `+st.cmd)
+			updated = append(updated, actual...)
+			continue
+		}
+		if !matchLines(st.expected, actual) {
+			t.Errorf("%s: $ %s\nexpected:\n%s\ngot:\n%s",
+				filepath.Base(path), st.cmd,
+				strings.Join(st.expected, "\n"), strings.Join(actual, "\n"))
+		}
+	}
+
+	if *Update {
+		if err := os.WriteFile(path, []byte(strings.Join(updated, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runStep runs a single shell command line (via `sh -c`, so pipelines
+// and quoting in the transcript behave as written) from inside the
+// sandboxed fixture keg, substituting "keg" at the start of the
+// command for the freshly built binary.
+//
+// current() treats $KEG_CURRENT as the name of a keg registered under
+// map.NAME config, not a literal path, so it can't be pointed at a
+// fresh fixture directory directly; instead the command's working
+// directory is set to kegdir itself, which current()'s fallback cwd
+// check (a "keg" file in the working directory) resolves correctly.
+func runStep(t *testing.T, bin, home, kegdir, line string) []string {
+	t.Helper()
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, `keg `) || line == `keg` {
+		line = bin + line[len(`keg`):]
+	}
+	cmd := exec.Command(`sh`, `-c`, line)
+	cmd.Dir = kegdir
+	cmd.Env = append(os.Environ(),
+		`HOME=`+home,
+		`EDITOR=true`, // never block on an interactive editor
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Run() // a non-zero exit is reported via mismatched output, not a hard test failure
+	return toExpectedLines(out.String())
+}
+
+func toExpectedLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if l == "" {
+			lines[i] = `<BLANKLINE>`
+		}
+	}
+	return lines
+}
+
+// matchLines compares expected transcript lines against the actual
+// output lines. "<BLANKLINE>" matches an empty line, "*" within a
+// line is a glob wildcard (matched with filepath.Match), and a line
+// that is exactly "..." matches zero or more whole lines of output
+// (for output, like log timestamps, whose line count isn't stable).
+func matchLines(expected, actual []string) bool {
+	return matchFrom(expected, actual)
+}
+
+func matchFrom(expected, actual []string) bool {
+	if len(expected) == 0 {
+		return len(actual) == 0
+	}
+	e := expected[0]
+	if e == `...` {
+		for skip := 0; skip <= len(actual); skip++ {
+			if matchFrom(expected[1:], actual[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(actual) == 0 {
+		return false
+	}
+	a := actual[0]
+	if e == `<BLANKLINE>` {
+		e = ``
+	}
+	if a == `<BLANKLINE>` {
+		a = ``
+	}
+	if ok, err := filepath.Match(e, a); err != nil || !ok {
+		if e != a {
+			return false
+		}
+	}
+	return matchFrom(expected[1:], actual[1:])
+}
+
+// unpackFixture copies the fixture keg at testdata/<name> into dest,
+// used by the "# setup: NAME" transcript directive.
+func unpackFixture(name, dest string) error {
+	src := filepath.Join(`testdata`, name)
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("fixture %q not found under testdata: %w", name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("fixture %q is not a directory", name)
+	}
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		buf, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, buf, fi.Mode())
+	})
+}
@@ -0,0 +1,11 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+// Local identifies a keg that lives on the local filesystem, as
+// resolved by current().
+type Local struct {
+	Name string // the short name used in KEG_CURRENT and map.NAME config
+	Path string // the directory containing the keg's "keg" info file
+}
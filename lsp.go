@@ -0,0 +1,557 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	Z "github.com/rwxrob/bonzai/z"
+	"github.com/rwxrob/help"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var lspCmd = &Z.Cmd{
+	Name:     `lsp`,
+	Commands: []*Z.Cmd{help.Cmd},
+	Summary:  `run a KEGML language server over stdio`,
+
+	Description: `
+		The {{aka}} command starts a Language Server Protocol server on
+		stdin/stdout for editing {{pre "README.md"}} files inside the
+		current keg. Point Neovim, VSCode, or any other LSP client at
+		{{cmd "keg lsp"}} and get:
+
+		* completion of {{pre "[title](/N)"}} link targets while typing
+		  {{pre "["}} or {{pre "/"}}
+		* completion of tags parsed from YAML frontmatter
+		* go-to-definition on {{pre "/N"}} links, jumping to {{pre
+		  "N/README.md"}}
+		* hover previews of the target node's title
+		* diagnostics for broken links and duplicate titles
+
+		The server watches the keg root and refreshes its index whenever
+		a file changes on disk, so diagnostics and completions stay live
+		even when edits come from another tool.
+
+	`,
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		keg, err := current(x.Caller)
+		if err != nil {
+			return err
+		}
+		return RunLSP(keg.Path, os.Stdin, os.Stdout)
+	},
+}
+
+// lspServer holds the in-memory view of the keg that backs every LSP
+// request. It is rebuilt from disk on startup and whenever the
+// watcher observes a change.
+type lspServer struct {
+	root string
+	w    io.Writer
+	wmu  sync.Mutex
+	log  *log.Logger
+
+	mu     sync.RWMutex
+	nodes  map[int]lspNode  // by id
+	titles map[string][]int // lowercased title -> ids sharing it
+
+	docs sync.Map // uri (string) -> text (string), for open buffers
+}
+
+type lspNode struct {
+	N     int
+	Title string
+	Tags  []string
+}
+
+// RunLSP starts an LSP server rooted at kegdir, reading requests from
+// r and writing responses to w until the client sends "exit" or r is
+// closed.
+func RunLSP(kegdir string, r io.Reader, w io.Writer) error {
+	s := &lspServer{
+		root: kegdir,
+		w:    w,
+		log:  log.New(os.Stderr, `keg-lsp: `, log.LstdFlags),
+	}
+	s.reindex()
+	go s.watch()
+
+	reader := bufio.NewReader(r)
+	for {
+		msg, err := readLSPMessage(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := s.dispatch(msg); err != nil {
+			s.log.Println(`dispatch error:`, err)
+		}
+	}
+}
+
+// reindex walks root and rebuilds the node/title/tag tables used by
+// completion, hover, go-to-definition, and diagnostics.
+func (s *lspServer) reindex() {
+	nodes := map[int]lspNode{}
+	titles := map[string][]int{}
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(s.root, e.Name(), `README.md`)
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		fm := ParseFrontmatter(string(buf))
+		title := firstLine(fm.Body)
+		nodes[id] = lspNode{N: id, Title: title, Tags: fm.Tags}
+		titles[strings.ToLower(title)] = append(titles[strings.ToLower(title)], id)
+	}
+	s.mu.Lock()
+	s.nodes, s.titles = nodes, titles
+	s.mu.Unlock()
+}
+
+// watch refreshes the index whenever a README.md under root changes
+// or a node directory is created, so editors see live
+// completions/diagnostics without restarting the server.
+func (s *lspServer) watch() {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.log.Println(`watch disabled:`, err)
+		return
+	}
+	defer w.Close()
+	_ = w.Add(s.root)
+	entries, _ := os.ReadDir(s.root)
+	for _, e := range entries {
+		if e.IsDir() {
+			_ = w.Add(filepath.Join(s.root, e.Name()))
+		}
+	}
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if strings.HasSuffix(ev.Name, `README.md`) || ev.Op&fsnotify.Create != 0 {
+				if ev.Op&fsnotify.Create != 0 {
+					_ = w.Add(ev.Name)
+				}
+				s.reindex()
+				s.publishAllDiagnostics()
+			}
+		case _, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+func firstLine(body string) string {
+	title := body
+	if i := strings.Index(body, "\n"); i >= 0 {
+		title = body[:i]
+	}
+	return strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(title), `#`))
+}
+
+// ----------------------------- JSON-RPC -----------------------------
+
+type lspMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// readLSPMessage reads one Content-Length-framed JSON-RPC message, as
+// specified by the LSP base protocol.
+func readLSPMessage(r *bufio.Reader) (*lspMessage, error) {
+	var length int
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, `Content-Length:`) {
+			n, err := strconv.Atoi(strings.TrimSpace(line[len(`Content-Length:`):]))
+			if err != nil {
+				return nil, err
+			}
+			length = n
+		}
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	msg := &lspMessage{}
+	if err := json.Unmarshal(buf, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *lspServer) send(v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		s.log.Println(`marshal error:`, err)
+		return
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) reply(id json.RawMessage, result any) {
+	s.send(map[string]any{`jsonrpc`: `2.0`, `id`: id, `result`: result})
+}
+
+func (s *lspServer) notify(method string, params any) {
+	s.send(map[string]any{`jsonrpc`: `2.0`, `method`: method, `params`: params})
+}
+
+func (s *lspServer) dispatch(msg *lspMessage) error {
+	switch msg.Method {
+	case `initialize`:
+		return s.handleInitialize(msg)
+	case `textDocument/didOpen`:
+		return s.handleDidOpen(msg)
+	case `textDocument/didChange`:
+		return s.handleDidChange(msg)
+	case `textDocument/completion`:
+		return s.handleCompletion(msg)
+	case `textDocument/definition`:
+		return s.handleDefinition(msg)
+	case `textDocument/hover`:
+		return s.handleHover(msg)
+	case `shutdown`:
+		s.reply(msg.ID, nil)
+	case `exit`:
+		os.Exit(0)
+	}
+	return nil
+}
+
+// --------------------------- text document ---------------------------
+
+type lspTextDocItem struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspDidOpenParams struct {
+	TextDocument lspTextDocItem `json:"textDocument"`
+}
+
+func (s *lspServer) handleDidOpen(msg *lspMessage) error {
+	var p lspDidOpenParams
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return err
+	}
+	s.docs.Store(p.TextDocument.URI, p.TextDocument.Text)
+	s.publishDiagnostics(p.TextDocument.URI, p.TextDocument.Text)
+	return nil
+}
+
+type lspContentChange struct {
+	Text string `json:"text"`
+}
+
+type lspDidChangeParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	ContentChanges []lspContentChange `json:"contentChanges"`
+}
+
+func (s *lspServer) handleDidChange(msg *lspMessage) error {
+	var p lspDidChangeParams
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return err
+	}
+	if len(p.ContentChanges) == 0 {
+		return nil
+	}
+	text := p.ContentChanges[len(p.ContentChanges)-1].Text
+	s.docs.Store(p.TextDocument.URI, text)
+	s.publishDiagnostics(p.TextDocument.URI, text)
+	return nil
+}
+
+// ------------------------------ init ------------------------------
+
+func (s *lspServer) handleInitialize(msg *lspMessage) error {
+	result := map[string]any{
+		`capabilities`: map[string]any{
+			`textDocumentSync`:   1, // full document sync
+			`completionProvider`: map[string]any{`triggerCharacters`: []string{`[`, `/`, `#`}},
+			`definitionProvider`: true,
+			`hoverProvider`:      true,
+		},
+		`serverInfo`: map[string]any{`name`: `keg-lsp`, `version`: cmdVersion},
+	}
+	s.reply(msg.ID, result)
+	return nil
+}
+
+// ---------------------------- completion ----------------------------
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspTextDocPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+func (s *lspServer) lineAt(uri string, pos lspPosition) string {
+	v, ok := s.docs.Load(uri)
+	if !ok {
+		return ``
+	}
+	lines := strings.Split(v.(string), "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return ``
+	}
+	line := lines[pos.Line]
+	if pos.Character < len(line) {
+		return line[:pos.Character]
+	}
+	return line
+}
+
+func (s *lspServer) handleCompletion(msg *lspMessage) error {
+	var p lspTextDocPositionParams
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return err
+	}
+	prefix := s.lineAt(p.TextDocument.URI, p.Position)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var items []map[string]any
+	switch {
+	case strings.HasSuffix(prefix, `[`), strings.Contains(prefix, `[`) && !strings.Contains(prefix, `]`):
+		for id := range s.nodes {
+			n := s.nodes[id]
+			items = append(items, map[string]any{
+				`label`:      fmt.Sprintf(`%s](/%d)`, n.Title, n.N),
+				`kind`:       17, // Reference
+				`detail`:     fmt.Sprintf(`node /%d`, n.N),
+				`insertText`: fmt.Sprintf(`%s](/%d)`, n.Title, n.N),
+			})
+		}
+	case strings.HasSuffix(prefix, `/`):
+		for id := range s.nodes {
+			n := s.nodes[id]
+			items = append(items, map[string]any{
+				`label`:      strconv.Itoa(n.N),
+				`kind`:       12, // Value
+				`detail`:     n.Title,
+				`insertText`: strconv.Itoa(n.N),
+			})
+		}
+	default:
+		seen := map[string]bool{}
+		for _, n := range s.nodes {
+			for _, tag := range n.Tags {
+				if seen[tag] {
+					continue
+				}
+				seen[tag] = true
+				items = append(items, map[string]any{
+					`label`: tag,
+					`kind`:  14, // Keyword
+				})
+			}
+		}
+	}
+
+	s.reply(msg.ID, map[string]any{`isIncomplete`: false, `items`: items})
+	return nil
+}
+
+// --------------------------- go-to-definition ---------------------------
+
+// lspLinkRE matches a KEGML node link, e.g. "](/123)", and must stay
+// anchored on the "](" prefix (matching index.go's linkRE) so that
+// ordinary prose containing a "/123"-shaped substring isn't mistaken
+// for a link.
+var lspLinkRE = regexp.MustCompile(`\]\(/(\d+)\)`)
+
+func (s *lspServer) handleDefinition(msg *lspMessage) error {
+	var p lspTextDocPositionParams
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return err
+	}
+	id, ok := s.linkAt(p.TextDocument.URI, p.Position)
+	if !ok {
+		s.reply(msg.ID, nil)
+		return nil
+	}
+	target := filepath.Join(s.root, strconv.Itoa(id), `README.md`)
+	s.reply(msg.ID, map[string]any{
+		`uri`: `file://` + target,
+		`range`: map[string]any{
+			`start`: map[string]any{`line`: 0, `character`: 0},
+			`end`:   map[string]any{`line`: 0, `character`: 0},
+		},
+	})
+	return nil
+}
+
+func (s *lspServer) handleHover(msg *lspMessage) error {
+	var p lspTextDocPositionParams
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return err
+	}
+	id, ok := s.linkAt(p.TextDocument.URI, p.Position)
+	if !ok {
+		s.reply(msg.ID, nil)
+		return nil
+	}
+	s.mu.RLock()
+	n, found := s.nodes[id]
+	s.mu.RUnlock()
+	if !found {
+		s.reply(msg.ID, map[string]any{
+			`contents`: fmt.Sprintf(`**/%d** — broken link (no such node)`, id),
+		})
+		return nil
+	}
+	s.reply(msg.ID, map[string]any{`contents`: fmt.Sprintf(`**/%d** %s`, n.N, n.Title)})
+	return nil
+}
+
+// linkAt finds the /N link, if any, under the cursor on the given
+// line of the document at uri.
+func (s *lspServer) linkAt(uri string, pos lspPosition) (int, bool) {
+	v, ok := s.docs.Load(uri)
+	if !ok {
+		return 0, false
+	}
+	lines := strings.Split(v.(string), "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return 0, false
+	}
+	line := lines[pos.Line]
+	for _, m := range lspLinkRE.FindAllStringSubmatchIndex(line, -1) {
+		if pos.Character >= m[0] && pos.Character <= m[1] {
+			id, err := strconv.Atoi(line[m[2]:m[3]])
+			if err == nil {
+				return id, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ---------------------------- diagnostics ----------------------------
+
+type lspDiagnostic struct {
+	Range    map[string]any `json:"range"`
+	Severity int            `json:"severity"`
+	Message  string         `json:"message"`
+}
+
+// publishDiagnostics scans text for broken links and duplicate
+// titles, skipping anything inside fenced code blocks, and sends the
+// results as a textDocument/publishDiagnostics notification.
+func (s *lspServer) publishDiagnostics(uri, text string) {
+	s.mu.RLock()
+	nodes, titles := s.nodes, s.titles
+	s.mu.RUnlock()
+
+	var diags []lspDiagnostic
+	inFence := false
+	for lineNum, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+		for _, m := range lspLinkRE.FindAllStringSubmatchIndex(line, -1) {
+			id, err := strconv.Atoi(line[m[2]:m[3]])
+			if err != nil {
+				continue
+			}
+			if _, ok := nodes[id]; ok {
+				continue
+			}
+			diags = append(diags, lspDiagnostic{
+				Range:    lspLineRange(lineNum, m[0], m[1]),
+				Severity: 1, // Error
+				Message:  fmt.Sprintf(`broken link: node /%d does not exist`, id),
+			})
+		}
+	}
+	ownTitle := firstLine(ParseFrontmatter(text).Body)
+	if ids := titles[strings.ToLower(ownTitle)]; len(ids) > 1 {
+		diags = append(diags, lspDiagnostic{
+			Range:    lspLineRange(0, 0, len(ownTitle)),
+			Severity: 2, // Warning
+			Message:  fmt.Sprintf(`duplicate title shared with node(s) %v`, ids),
+		})
+	}
+
+	s.notify(`textDocument/publishDiagnostics`, map[string]any{
+		`uri`:         uri,
+		`diagnostics`: diags,
+	})
+}
+
+// publishAllDiagnostics re-runs publishDiagnostics for every open
+// buffer, used after the watcher detects an on-disk change.
+func (s *lspServer) publishAllDiagnostics() {
+	s.docs.Range(func(k, v any) bool {
+		s.publishDiagnostics(k.(string), v.(string))
+		return true
+	})
+}
+
+func lspLineRange(line, start, end int) map[string]any {
+	return map[string]any{
+		`start`: map[string]any{`line`: line, `character`: start},
+		`end`:   map[string]any{`line`: line, `character`: end},
+	}
+}
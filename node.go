@@ -0,0 +1,81 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rwxrob/fs/file"
+)
+
+// MakeNode creates a new, empty content node directory in kegdir
+// (named with the next unused integer id) and returns its entry. The
+// caller is responsible for filling in and indexing its content.
+func MakeNode(kegdir string) (*DexEntry, error) {
+	entries, err := os.ReadDir(kegdir)
+	if err != nil {
+		return nil, err
+	}
+	next := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if n, err := strconv.Atoi(e.Name()); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	dir := filepath.Join(kegdir, strconv.Itoa(next))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, `README.md`)
+	if err := file.Overwrite(path, ""); err != nil {
+		return nil, err
+	}
+	return &DexEntry{N: next}, nil
+}
+
+// Edit opens the README.md of node id in kegdir with $EDITOR.
+func Edit(kegdir string, id int) error {
+	return file.Edit(filepath.Join(kegdir, strconv.Itoa(id), `README.md`))
+}
+
+// WriteSample overwrites entry's node with the built-in KEGML sample
+// content, the same content used to seed the zero node on init.
+func WriteSample(kegdir string, entry *DexEntry) error {
+	path := filepath.Join(kegdir, entry.ID(), `README.md`)
+	return file.Overwrite(path, DefaultZeroNode)
+}
+
+// Last returns the most recently modified node in kegdir, or nil if
+// the keg has no nodes yet.
+func Last(kegdir string) *DexEntry {
+	entries, err := os.ReadDir(kegdir)
+	if err != nil {
+		return nil
+	}
+	var best *DexEntry
+	var bestMod int64
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if best == nil || info.ModTime().Unix() > bestMod {
+			best = &DexEntry{N: id}
+			bestMod = info.ModTime().Unix()
+		}
+	}
+	return best
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	Z "github.com/rwxrob/bonzai/z"
+	"github.com/rwxrob/help"
+	"github.com/rwxrob/term"
+)
+
+// Frontmatter is the optional YAML block at the very top of a
+// README.md, delimited by a line of exactly "---" before and after.
+// Only simple "key: value" lines and the tags: list are understood;
+// anything else in the block is ignored (the whole block, closing
+// "---" included, is stripped from Body).
+type Frontmatter struct {
+	Tags   []string
+	Fields map[string]string // every other "key: value" line, keyed lowercase
+	Body   string            // the README.md content with the frontmatter stripped
+}
+
+// ParseFrontmatter splits the optional leading YAML frontmatter block
+// off of a node's raw README.md text and extracts its tags: list. If
+// body does not begin with a "---" delimiter it is returned unchanged
+// with no tags, so calling this on a node with no frontmatter is
+// always safe.
+func ParseFrontmatter(body string) Frontmatter {
+	lines := strings.Split(body, "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != `---` {
+		return Frontmatter{Body: body}
+	}
+
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == `---` {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return Frontmatter{Body: body}
+	}
+
+	// Tags may be written inline ("tags: [a, b]" / "tags: a, b") or as
+	// a YAML block list ("tags:\n  - a\n  - b"); sawTags tracks whether
+	// we're still inside a block list started by a bare "tags:" line.
+	// Every other "key: value" line is captured verbatim into Fields.
+	var tags []string
+	fields := map[string]string{}
+	sawTags := false
+	for _, line := range lines[1:end] {
+		trimmed := strings.TrimSpace(line)
+		low := strings.ToLower(trimmed)
+		if strings.HasPrefix(low, `tags:`) {
+			rest := strings.TrimSpace(trimmed[len(`tags:`):])
+			if rest == "" {
+				sawTags = true
+				continue
+			}
+			sawTags = false
+			rest = strings.Trim(rest, `[]`)
+			for _, t := range strings.Split(rest, `,`) {
+				t = strings.Trim(strings.TrimSpace(t), `"'`)
+				if t != "" {
+					tags = append(tags, t)
+				}
+			}
+			continue
+		}
+		if sawTags && strings.HasPrefix(trimmed, `-`) {
+			t := strings.Trim(strings.TrimSpace(trimmed[1:]), `"'`)
+			if t != "" {
+				tags = append(tags, t)
+			}
+			continue
+		}
+		sawTags = false
+		if key, val, ok := strings.Cut(trimmed, `:`); ok {
+			key = strings.ToLower(strings.TrimSpace(key))
+			val = strings.Trim(strings.TrimSpace(val), `"'`)
+			if key != "" && val != "" {
+				fields[key] = val
+			}
+		}
+	}
+
+	return Frontmatter{
+		Tags:   tags,
+		Fields: fields,
+		Body:   strings.Join(lines[end+1:], "\n"),
+	}
+}
+
+var tagsCmd = &Z.Cmd{
+	Name:     `tags`,
+	Commands: []*Z.Cmd{help.Cmd},
+	Summary:  `list all tags in the current keg with counts`,
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		keg, err := current(x.Caller)
+		if err != nil {
+			return err
+		}
+		ix, err := OpenIndex(keg.Path)
+		if err != nil {
+			return err
+		}
+		defer ix.Close()
+		counts, err := ix.TagCounts()
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-20s %d\n", name, counts[name])
+		}
+		return nil
+	},
+}
+
+var tagCmd = &Z.Cmd{
+	Name:     `tag`,
+	Usage:    `TAG`,
+	Summary:  `list nodes carrying a tag`,
+	Commands: []*Z.Cmd{help.Cmd},
+
+	Call: func(x *Z.Cmd, args ...string) error {
+		if len(args) == 0 {
+			return x.UsageError()
+		}
+		keg, err := current(x.Caller)
+		if err != nil {
+			return err
+		}
+		dex, err := ReadDex(keg.Path)
+		if err != nil {
+			return err
+		}
+		dex, err = filterDex(keg.Path, dex, FilterOpts{Tag: args[0]})
+		if err != nil {
+			return err
+		}
+		if term.IsInteractive() {
+			Z.Page(dex.Pretty())
+		} else {
+			fmt.Print(dex.AsIncludes())
+		}
+		return nil
+	},
+}
+
+// TagCounts returns every tag in the index along with how many nodes
+// carry it.
+func (ix *Index) TagCounts() (map[string]int, error) {
+	rows, err := ix.db.Query(`select tag, count(*) from tags group by tag`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]int{}
+	for rows.Next() {
+		var tag string
+		var n int
+		if err := rows.Scan(&tag, &n); err != nil {
+			return nil, err
+		}
+		out[tag] = n
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Robert Muhlestein.
+// SPDX-License-Identifier: Apache-2.0
+
+package keg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFrontmatter(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		tags []string
+		flds map[string]string
+		rest string
+	}{
+		{
+			name: `no frontmatter`,
+			body: "# Title\n\nbody text\n",
+			rest: "# Title\n\nbody text\n",
+		},
+		{
+			name: `inline bracketed tags`,
+			body: "---\ntags: [one, two]\n---\n# Title\n",
+			tags: []string{`one`, `two`},
+			rest: "# Title\n",
+		},
+		{
+			name: `inline unbracketed tags with quotes`,
+			body: "---\ntags: \"one\", 'two'\n---\n# Title\n",
+			tags: []string{`one`, `two`},
+			rest: "# Title\n",
+		},
+		{
+			name: `yaml block-list tags`,
+			body: "---\ntags:\n  - one\n  - two\n---\n# Title\n",
+			tags: []string{`one`, `two`},
+			rest: "# Title\n",
+		},
+		{
+			name: `other fields captured`,
+			body: "---\ndate: 2023-01-02\ntags: [daily]\n---\n# Title\n",
+			tags: []string{`daily`},
+			flds: map[string]string{`date`: `2023-01-02`},
+			rest: "# Title\n",
+		},
+		{
+			name: `unterminated frontmatter is left as body`,
+			body: "---\ntags: [one]\n# Title\n",
+			rest: "---\ntags: [one]\n# Title\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fm := ParseFrontmatter(c.body)
+			if !reflect.DeepEqual(fm.Tags, c.tags) {
+				t.Errorf("tags: got %v, want %v", fm.Tags, c.tags)
+			}
+			if c.flds != nil && !reflect.DeepEqual(fm.Fields, c.flds) {
+				t.Errorf("fields: got %v, want %v", fm.Fields, c.flds)
+			}
+			if fm.Body != c.rest {
+				t.Errorf("body: got %q, want %q", fm.Body, c.rest)
+			}
+		})
+	}
+}